@@ -0,0 +1,179 @@
+// Package authzenforce rewrites or filters the non-query Prometheus and Loki
+// HTTP APIs (series, labels, label values, rules, alerts) so that the authz
+// matchers returned by OPA are applied consistently across the whole API
+// surface, not just the "query" parameter handled in package http.
+package authzenforce
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// MatchParam is the repeatable URL parameter used by the series, label-names
+// and label-values endpoints to scope the request to a set of selectors.
+const MatchParam = "match[]"
+
+// Series rewrites every match[] selector in v so that it also satisfies
+// groups, applied according to enforceMode.
+func Series(v url.Values, groups []MatcherGroup, enforceMode string) (url.Values, error) {
+	selectors := v[MatchParam]
+	if len(selectors) == 0 {
+		selectors = []string{"{}"}
+	}
+
+	rewritten := make([]string, 0, len(selectors))
+
+	for _, sel := range selectors {
+		parsed, err := parser.ParseMetricSelector(sel)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing match[] selector %q: %w", sel, err)
+		}
+
+		filtered, toAppend, err := Resolve(parsed, groups, enforceMode)
+		if err != nil {
+			return nil, err
+		}
+
+		rewritten = append(rewritten, formatSelector(append(filtered, toAppend...)))
+	}
+
+	v[MatchParam] = rewritten
+
+	return v, nil
+}
+
+// Labels ensures v carries at least one match[] selector built from groups,
+// for the label-names and label-values endpoints, which accept match[] as an
+// optional filter rather than a required one.
+func Labels(v url.Values, groups []MatcherGroup, enforceMode string) (url.Values, error) {
+	if len(v[MatchParam]) == 0 {
+		_, toAppend, err := Resolve(nil, groups, enforceMode)
+		if err != nil {
+			return nil, err
+		}
+
+		v.Add(MatchParam, formatSelector(toAppend))
+
+		return v, nil
+	}
+
+	return Series(v, groups, enforceMode)
+}
+
+func formatSelector(matchers []*labels.Matcher) string {
+	parts := make([]string, len(matchers))
+	for i, m := range matchers {
+		parts[i] = m.String()
+	}
+
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// FilterRulesOrAlerts drops entries from a Prometheus /api/v1/rules or
+// /api/v1/alerts JSON response body whose labels don't satisfy groups, and
+// returns the filtered body re-encoded as JSON.
+func FilterRulesOrAlerts(body []byte, groups []MatcherGroup) ([]byte, error) {
+	matchers := make([]*labels.Matcher, 0, len(groups))
+	for _, g := range groups {
+		gm := g.Matchers
+		if g.Op == OpOr {
+			var err error
+
+			gm, err = CoalesceOr(gm)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		matchers = append(matchers, gm...)
+	}
+
+	var resp struct {
+		Status string          `json:"status"`
+		Data   json.RawMessage `json:"data"`
+	}
+
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("failed parsing rules/alerts response: %w", err)
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return nil, fmt.Errorf("failed parsing rules/alerts data: %w", err)
+	}
+
+	if alerts, ok := data["alerts"].([]interface{}); ok {
+		data["alerts"] = filterEntries(alerts, matchers)
+	}
+
+	if groups, ok := data["groups"].([]interface{}); ok {
+		for i, g := range groups {
+			group, ok := g.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			if rules, ok := group["rules"].([]interface{}); ok {
+				group["rules"] = filterEntries(rules, matchers)
+			}
+
+			groups[i] = group
+		}
+
+		data["groups"] = groups
+	}
+
+	filteredData, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed re-encoding rules/alerts data: %w", err)
+	}
+
+	resp.Data = filteredData
+
+	out, err := json.Marshal(resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed re-encoding rules/alerts response: %w", err)
+	}
+
+	return out, nil
+}
+
+// filterEntries keeps only the entries whose "labels" object satisfies every
+// matcher.
+func filterEntries(entries []interface{}, matchers []*labels.Matcher) []interface{} {
+	kept := make([]interface{}, 0, len(entries))
+
+	for _, e := range entries {
+		entry, ok := e.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if matches(entry["labels"], matchers) {
+			kept = append(kept, entry)
+		}
+	}
+
+	return kept
+}
+
+func matches(rawLabels interface{}, matchers []*labels.Matcher) bool {
+	lbls, ok := rawLabels.(map[string]interface{})
+	if !ok {
+		return false
+	}
+
+	for _, m := range matchers {
+		v, _ := lbls[m.Name].(string)
+		if !m.Matches(v) {
+			return false
+		}
+	}
+
+	return true
+}
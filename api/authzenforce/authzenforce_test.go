@@ -0,0 +1,92 @@
+package authzenforce
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func mustMatcher(t *testing.T, mType labels.MatchType, name, value string) *labels.Matcher {
+	t.Helper()
+
+	m, err := labels.NewMatcher(mType, name, value)
+	if err != nil {
+		t.Fatalf("failed building matcher: %v", err)
+	}
+
+	return m
+}
+
+func TestSeriesAppendsMatchersToEverySelector(t *testing.T) {
+	groups := []MatcherGroup{
+		{Op: OpAnd, Matchers: []*labels.Matcher{mustMatcher(t, labels.MatchEqual, "namespace", "a")}},
+	}
+
+	v := url.Values{MatchParam: []string{`{job="x"}`, `{job="y"}`}}
+
+	rewritten, err := Series(v, groups, EnforceModeAppend)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, sel := range rewritten[MatchParam] {
+		if !strings.Contains(sel, `namespace="a"`) {
+			t.Fatalf("selector %q does not carry the injected matcher", sel)
+		}
+	}
+}
+
+func TestLabelsWithoutMatchParamInjectsOne(t *testing.T) {
+	groups := []MatcherGroup{
+		{Op: OpAnd, Matchers: []*labels.Matcher{mustMatcher(t, labels.MatchEqual, "namespace", "a")}},
+	}
+
+	rewritten, err := Labels(url.Values{}, groups, EnforceModeAppend)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	selectors := rewritten[MatchParam]
+	if len(selectors) != 1 || !strings.Contains(selectors[0], `namespace="a"`) {
+		t.Fatalf("expected a single synthesized match[] selector carrying the matcher, got %v", selectors)
+	}
+}
+
+func TestFilterRulesOrAlertsKeepsOnlyMatchingEntries(t *testing.T) {
+	groups := []MatcherGroup{
+		{Op: OpAnd, Matchers: []*labels.Matcher{mustMatcher(t, labels.MatchEqual, "namespace", "a")}},
+	}
+
+	body := []byte(`{
+		"status": "success",
+		"data": {
+			"alerts": [
+				{"labels": {"namespace": "a"}},
+				{"labels": {"namespace": "b"}}
+			],
+			"groups": [
+				{"rules": [
+					{"labels": {"namespace": "a"}},
+					{"labels": {"namespace": "b"}}
+				]}
+			]
+		}
+	}`)
+
+	filtered, err := FilterRulesOrAlerts(body, groups)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := string(filtered)
+
+	if !strings.Contains(got, `"namespace":"a"`) {
+		t.Fatalf("expected the namespace=a entries to survive filtering, got %s", got)
+	}
+
+	if strings.Contains(got, `"namespace":"b"`) {
+		t.Fatalf("expected the namespace=b entries to be dropped, got %s", got)
+	}
+}
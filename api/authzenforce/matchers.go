@@ -0,0 +1,371 @@
+package authzenforce
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// Matcher group operators.
+const (
+	OpOr  = "or"
+	OpAnd = "and"
+)
+
+// Enforce modes for MatcherGroup application.
+const (
+	// EnforceModeAppend ANDs the authz matchers onto the selector, in
+	// addition to whatever the user already supplied. This is the default.
+	EnforceModeAppend = "append"
+	// EnforceModeReplace drops any user-supplied matcher for a label the
+	// authz matchers also constrain, then appends the authz matchers.
+	EnforceModeReplace = "replace"
+	// EnforceModeIntersect rejects the request instead of rewriting it, if
+	// the user-supplied matcher for a label isn't a subset of the authz
+	// matcher for that same label.
+	EnforceModeIntersect = "intersect"
+)
+
+// MatcherGroup is one group of the richer AuthzResponseData schema: Op
+// controls how Matchers combine with each other ("or" coalesces same-label
+// equality matchers into a single regex, "and" appends them all).
+type MatcherGroup struct {
+	Op       string            `json:"op,omitempty"`
+	Matchers []*labels.Matcher `json:"matchers"`
+}
+
+// Resolve returns the existing matchers filtered for enforceMode (only
+// EnforceModeReplace actually drops anything) and the matchers that must be
+// appended on top, given the groups and enforceMode returned by OPA. It
+// mutates neither existing nor groups; callers build their selector from
+// append(filteredExisting, toAppend...).
+func Resolve(existing []*labels.Matcher, groups []MatcherGroup, enforceMode string) (filteredExisting, toAppend []*labels.Matcher, err error) {
+	filteredExisting = existing
+
+	for _, g := range groups {
+		gm := g.Matchers
+		if g.Op == OpOr {
+			var err error
+
+			gm, err = CoalesceOr(gm)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		switch enforceMode {
+		case EnforceModeIntersect:
+			unconstrained, err := checkIntersect(filteredExisting, gm)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			toAppend = append(toAppend, unconstrained...)
+		case EnforceModeReplace:
+			filteredExisting = dropMatching(filteredExisting, gm)
+			toAppend = append(toAppend, gm...)
+		default:
+			toAppend = append(toAppend, gm...)
+		}
+	}
+
+	return filteredExisting, toAppend, nil
+}
+
+// CoalesceOr collapses multiple equality matchers on the same label into a
+// single `=~` regex matcher, so a stream/vector selector — which ANDs its
+// label matchers together — can still express "label is A or B". Matchers
+// that aren't plain equality, or that are alone for their label, pass
+// through unchanged.
+//
+// An "or" group spanning more than one label name (e.g. namespace=a OR
+// team=x) can't be expressed this way: ANDing the per-label results back
+// onto a selector would silently turn it into an AND, so that shape is
+// rejected instead of being misenforced without any signal to the policy
+// author.
+func CoalesceOr(matchers []*labels.Matcher) ([]*labels.Matcher, error) {
+	var order []string
+
+	byName := map[string][]*labels.Matcher{}
+
+	for _, m := range matchers {
+		if _, ok := byName[m.Name]; !ok {
+			order = append(order, m.Name)
+		}
+
+		byName[m.Name] = append(byName[m.Name], m)
+	}
+
+	if len(order) > 1 {
+		return nil, fmt.Errorf("an \"or\" matcher group must constrain a single label, got %d: %s", len(order), strings.Join(order, ", "))
+	}
+
+	out := make([]*labels.Matcher, 0, len(matchers))
+
+	for _, name := range order {
+		out = append(out, coalesceGroup(name, byName[name])...)
+	}
+
+	return out, nil
+}
+
+func coalesceGroup(name string, ms []*labels.Matcher) []*labels.Matcher {
+	if len(ms) == 1 {
+		return ms
+	}
+
+	values := make([]string, 0, len(ms))
+
+	for _, m := range ms {
+		if m.Type != labels.MatchEqual {
+			return ms
+		}
+
+		values = append(values, regexp.QuoteMeta(m.Value))
+	}
+
+	re, err := labels.NewMatcher(labels.MatchRegexp, name, strings.Join(values, "|"))
+	if err != nil {
+		return ms
+	}
+
+	return []*labels.Matcher{re}
+}
+
+// dropMatching removes every matcher from existing whose label name is also
+// constrained by replacements.
+func dropMatching(existing []*labels.Matcher, replacements []*labels.Matcher) []*labels.Matcher {
+	replaced := make(map[string]bool, len(replacements))
+	for _, m := range replacements {
+		replaced[m.Name] = true
+	}
+
+	out := existing[:0:0]
+
+	for _, m := range existing {
+		if !replaced[m.Name] {
+			out = append(out, m)
+		}
+	}
+
+	return out
+}
+
+// ForbiddenError is returned when EnforceModeIntersect rejects a request. It
+// carries one human-readable reason per offending label so callers can
+// surface a structured, actionable denial instead of an opaque error.
+type ForbiddenError struct {
+	Reasons []string
+}
+
+func (e *ForbiddenError) Error() string {
+	return fmt.Sprintf("request forbidden by authorization policy: %s", strings.Join(e.Reasons, "; "))
+}
+
+// checkIntersect rejects a request whose user-supplied matcher for a label
+// is not a subset of the corresponding authz matcher, and returns the authz
+// matchers for labels the user left unconstrained, so the caller still
+// enforces them by appending instead of silently letting the request through
+// unrestricted.
+func checkIntersect(existing []*labels.Matcher, authzMatchers []*labels.Matcher) ([]*labels.Matcher, error) {
+	var (
+		reasons       []string
+		unconstrained []*labels.Matcher
+	)
+
+	for _, am := range authzMatchers {
+		um := findByName(existing, am.Name)
+		if um == nil {
+			unconstrained = append(unconstrained, am)
+
+			continue
+		}
+
+		ok, err := isSubset(um, am)
+		if err != nil {
+			return nil, fmt.Errorf("failed checking label %q against authorization matchers: %w", am.Name, err)
+		}
+
+		if !ok {
+			reasons = append(reasons, fmt.Sprintf("label %q value %q is not allowed by authorization policy", am.Name, um.Value))
+		}
+	}
+
+	if len(reasons) > 0 {
+		return nil, &ForbiddenError{Reasons: reasons}
+	}
+
+	return unconstrained, nil
+}
+
+func findByName(matchers []*labels.Matcher, name string) *labels.Matcher {
+	for _, m := range matchers {
+		if m.Name == name {
+			return m
+		}
+	}
+
+	return nil
+}
+
+// isSubset reports whether every value matched by user is also matched by
+// authz. Exact regular-language containment is undecidable for arbitrary
+// patterns, so this enumerates the finite set of exact values user can match
+// (it always can for equality and for regexes built only from literals,
+// alternation and concatenation of those — which is what CoalesceOr
+// produces) and checks each one against authz. Any pattern that isn't
+// reducible to such a finite set (wildcards, large character classes,
+// repetition, negative matchers) is conservatively treated as NOT a subset,
+// rather than risking a fail-open match via a textual approximation.
+func isSubset(user, authz *labels.Matcher) (bool, error) {
+	if user.Type == labels.MatchNotEqual || user.Type == labels.MatchNotRegexp {
+		return false, nil
+	}
+
+	if user.Type == labels.MatchEqual {
+		ok, err := matchesAuthz(user.Value, authz)
+
+		return ok, err
+	}
+
+	literals, ok := enumerateLiterals(user.Value)
+	if !ok || len(literals) == 0 {
+		return false, nil
+	}
+
+	for _, l := range literals {
+		ok, err := matchesAuthz(l, authz)
+		if err != nil {
+			return false, err
+		}
+
+		if !ok {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// matchesAuthz reports whether value satisfies authz.
+func matchesAuthz(value string, authz *labels.Matcher) (bool, error) {
+	switch authz.Type {
+	case labels.MatchEqual:
+		return value == authz.Value, nil
+	case labels.MatchNotEqual:
+		return value != authz.Value, nil
+	}
+
+	compiled, err := regexp.Compile("^(?:" + authz.Value + ")$")
+	if err != nil {
+		return false, err
+	}
+
+	if authz.Type == labels.MatchNotRegexp {
+		return !compiled.MatchString(value), nil
+	}
+
+	return compiled.MatchString(value), nil
+}
+
+// maxEnumeratedLiterals caps the number of exact values enumerateLiterals
+// will expand a pattern into, so a pathological alternation/concatenation
+// can't be used to exhaust memory; patterns that would exceed it are treated
+// as not enumerable.
+const maxEnumeratedLiterals = 64
+
+// enumerateLiterals returns the finite set of exact strings pattern can
+// match, if it's built only from literals, alternation and concatenation of
+// those (e.g. "a", "a|b", the "val1|val2|..." regex CoalesceOr produces).
+// regexp/syntax turns alternations of single characters such as "a|b" into
+// character classes, so classes of at most maxEnumeratedLiterals runes are
+// expanded too. It returns ok=false for anything else — wildcards, larger
+// character classes, case-insensitive literals, repetition, anchors — since
+// those can match an unbounded or non-enumerable set of values.
+func enumerateLiterals(pattern string) (values []string, ok bool) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, false
+	}
+
+	return enumerateRegexpLiterals(re.Simplify())
+}
+
+func enumerateRegexpLiterals(re *syntax.Regexp) ([]string, bool) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return nil, false
+		}
+
+		return []string{string(re.Rune)}, true
+	case syntax.OpCharClass:
+		var out []string
+
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			for r := re.Rune[i]; r <= re.Rune[i+1]; r++ {
+				out = append(out, string(r))
+
+				if len(out) > maxEnumeratedLiterals {
+					return nil, false
+				}
+			}
+		}
+
+		return out, true
+	case syntax.OpEmptyMatch:
+		return []string{""}, true
+	case syntax.OpCapture:
+		return enumerateRegexpLiterals(re.Sub[0])
+	case syntax.OpConcat:
+		combos := []string{""}
+
+		for _, sub := range re.Sub {
+			subLiterals, ok := enumerateRegexpLiterals(sub)
+			if !ok {
+				return nil, false
+			}
+
+			next := make([]string, 0, len(combos)*len(subLiterals))
+
+			for _, prefix := range combos {
+				for _, lit := range subLiterals {
+					next = append(next, prefix+lit)
+				}
+			}
+
+			if len(next) > maxEnumeratedLiterals {
+				return nil, false
+			}
+
+			combos = next
+		}
+
+		return combos, true
+	case syntax.OpAlternate:
+		var out []string
+
+		for _, sub := range re.Sub {
+			subLiterals, ok := enumerateRegexpLiterals(sub)
+			if !ok {
+				return nil, false
+			}
+
+			out = append(out, subLiterals...)
+
+			if len(out) > maxEnumeratedLiterals {
+				return nil, false
+			}
+		}
+
+		return out, true
+	default:
+		// OpStar, OpPlus, OpQuest, OpAnyChar, OpAnyCharNotNL,
+		// OpBeginLine/OpEndLine and friends don't reduce to a finite,
+		// enumerable set of exact values.
+		return nil, false
+	}
+}
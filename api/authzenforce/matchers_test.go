@@ -0,0 +1,201 @@
+package authzenforce
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func matcher(t *testing.T, mType labels.MatchType, name, value string) *labels.Matcher {
+	t.Helper()
+
+	m, err := labels.NewMatcher(mType, name, value)
+	if err != nil {
+		t.Fatalf("failed building matcher: %v", err)
+	}
+
+	return m
+}
+
+func TestCoalesceOrCombinesEqualityMatchers(t *testing.T) {
+	ms := []*labels.Matcher{
+		matcher(t, labels.MatchEqual, "namespace", "a"),
+		matcher(t, labels.MatchEqual, "namespace", "b"),
+	}
+
+	out, err := CoalesceOr(ms)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(out) != 1 {
+		t.Fatalf("expected a single coalesced matcher, got %d", len(out))
+	}
+
+	if out[0].Type != labels.MatchRegexp {
+		t.Fatalf("expected a regexp matcher, got %v", out[0].Type)
+	}
+
+	if !out[0].Matches("a") || !out[0].Matches("b") || out[0].Matches("c") {
+		t.Fatalf("coalesced matcher %v does not match exactly {a, b}", out[0])
+	}
+}
+
+func TestCoalesceOrLeavesNonEqualityMatchersAlone(t *testing.T) {
+	ms := []*labels.Matcher{
+		matcher(t, labels.MatchRegexp, "namespace", "a.*"),
+		matcher(t, labels.MatchEqual, "namespace", "b"),
+	}
+
+	out, err := CoalesceOr(ms)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(out) != 2 {
+		t.Fatalf("expected matchers to pass through unchanged, got %d", len(out))
+	}
+}
+
+func TestCoalesceOrRejectsCrossLabelGroup(t *testing.T) {
+	ms := []*labels.Matcher{
+		matcher(t, labels.MatchEqual, "namespace", "a"),
+		matcher(t, labels.MatchEqual, "team", "x"),
+	}
+
+	if _, err := CoalesceOr(ms); err == nil {
+		t.Fatalf("expected an error for an \"or\" group spanning more than one label")
+	}
+}
+
+func TestResolveAppendMode(t *testing.T) {
+	existing := []*labels.Matcher{matcher(t, labels.MatchEqual, "job", "x")}
+	groups := []MatcherGroup{
+		{Op: OpAnd, Matchers: []*labels.Matcher{matcher(t, labels.MatchEqual, "namespace", "a")}},
+	}
+
+	filtered, toAppend, err := Resolve(existing, groups, EnforceModeAppend)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(filtered) != 1 || len(toAppend) != 1 {
+		t.Fatalf("expected existing untouched and the authz matcher appended, got filtered=%v toAppend=%v", filtered, toAppend)
+	}
+}
+
+func TestResolveReplaceModeDropsConflictingExisting(t *testing.T) {
+	existing := []*labels.Matcher{matcher(t, labels.MatchEqual, "namespace", "evil")}
+	groups := []MatcherGroup{
+		{Op: OpAnd, Matchers: []*labels.Matcher{matcher(t, labels.MatchEqual, "namespace", "a")}},
+	}
+
+	filtered, toAppend, err := Resolve(existing, groups, EnforceModeReplace)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, m := range filtered {
+		if m.Name == "namespace" {
+			t.Fatalf("expected the conflicting user-supplied namespace matcher to be dropped, got %v", filtered)
+		}
+	}
+
+	if len(toAppend) != 1 || toAppend[0].Value != "a" {
+		t.Fatalf("expected the authz matcher to be appended, got %v", toAppend)
+	}
+}
+
+func TestResolveIntersectModeRejectsDisallowedValue(t *testing.T) {
+	existing := []*labels.Matcher{matcher(t, labels.MatchEqual, "namespace", "evil")}
+	groups := []MatcherGroup{
+		{Op: OpAnd, Matchers: []*labels.Matcher{matcher(t, labels.MatchEqual, "namespace", "a")}},
+	}
+
+	_, _, err := Resolve(existing, groups, EnforceModeIntersect)
+	if err == nil {
+		t.Fatalf("expected an error rejecting the non-subset user matcher")
+	}
+
+	if _, ok := asForbidden(t, err); !ok {
+		t.Fatalf("expected a *ForbiddenError, got %T: %v", err, err)
+	}
+}
+
+func TestResolveIntersectModeStillEnforcesUnconstrainedLabel(t *testing.T) {
+	// The user's query doesn't mention "namespace" at all: intersect mode
+	// must still append the authz matcher rather than letting the request
+	// through unrestricted.
+	groups := []MatcherGroup{
+		{Op: OpAnd, Matchers: []*labels.Matcher{matcher(t, labels.MatchEqual, "namespace", "a")}},
+	}
+
+	filtered, toAppend, err := Resolve(nil, groups, EnforceModeIntersect)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(filtered) != 0 {
+		t.Fatalf("expected no existing matchers, got %v", filtered)
+	}
+
+	if len(toAppend) != 1 || toAppend[0].Name != "namespace" {
+		t.Fatalf("expected the unconstrained authz matcher to be appended, got %v", toAppend)
+	}
+}
+
+func TestIsSubsetRejectsNonEnumerableUserRegex(t *testing.T) {
+	// authz = namespace="a.b-teamX" (equality), user =~ "a.b" — the
+	// wildcard "." means the user pattern also matches "a1b", "axb", etc.,
+	// none of which the authz matcher allows, so this must NOT be treated
+	// as a subset despite "a.b" being a textual substring of "a.b-teamX".
+	user := matcher(t, labels.MatchRegexp, "namespace", "a.b")
+	authz := matcher(t, labels.MatchEqual, "namespace", "a.b-teamX")
+
+	ok, err := isSubset(user, authz)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if ok {
+		t.Fatalf("expected a.b (regex) to NOT be considered a subset of the literal a.b-teamX")
+	}
+}
+
+func TestIsSubsetAcceptsEnumerableAlternation(t *testing.T) {
+	// The user's regex is exactly the shape CoalesceOr produces: a plain
+	// alternation of literals, all of which the authz regex allows.
+	user := matcher(t, labels.MatchRegexp, "namespace", "a|b")
+	authz := matcher(t, labels.MatchRegexp, "namespace", "a|b|c")
+
+	ok, err := isSubset(user, authz)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !ok {
+		t.Fatalf("expected a|b to be a subset of a|b|c")
+	}
+}
+
+func TestIsSubsetRejectsAlternationWithDisallowedValue(t *testing.T) {
+	user := matcher(t, labels.MatchRegexp, "namespace", "a|z")
+	authz := matcher(t, labels.MatchRegexp, "namespace", "a|b|c")
+
+	ok, err := isSubset(user, authz)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if ok {
+		t.Fatalf("expected a|z to NOT be a subset of a|b|c since z isn't allowed")
+	}
+}
+
+func asForbidden(t *testing.T, err error) (*ForbiddenError, bool) {
+	t.Helper()
+
+	fe, ok := err.(*ForbiddenError)
+
+	return fe, ok
+}
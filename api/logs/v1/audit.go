@@ -0,0 +1,135 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/observatorium/api/authentication"
+	"github.com/observatorium/api/authorization"
+	"github.com/observatorium/api/authzenforce"
+)
+
+// AuditEvent describes one successful rewrite performed by
+// WithEnforceAuthorizationLabels, for operators who want to log or trace what
+// enforcement actually did to a request. WithEnforceTenancy takes no options
+// and emits no audit events.
+type AuditEvent struct {
+	Tenant           string
+	Subject          string
+	OriginalQuery    string
+	InjectedMatchers []string
+	FinalQuery       string
+}
+
+// WithAuditLogger registers a callback fired on every successful rewrite,
+// with the original query, the matchers injected, the final query string,
+// the tenant and the subject.
+func WithAuditLogger(fn func(AuditEvent)) Option {
+	return func(o *options) {
+		o.auditLogger = fn
+	}
+}
+
+// enforcementTotal is the observatorium_authz_enforcement_total counter
+// registered by WithPrometheusRegisterer. It's package-level because a
+// prometheus.CounterVec is itself safe for concurrent use and middleware
+// instances sharing a registerer should share one metric, not one per route.
+var enforcementTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "observatorium_authz_enforcement_total",
+		Help: "Total number of requests that went through authorization label enforcement, by result.",
+	},
+	[]string{"result"},
+)
+
+// Enforcement results recorded by the observatorium_authz_enforcement_total
+// counter.
+const (
+	resultSuccess   = "success"
+	resultForbidden = "forbidden"
+	resultError     = "error"
+)
+
+// WithPrometheusRegisterer registers the observatorium_authz_enforcement_total
+// counter (labeled by result: success, forbidden, error) with reg. Since
+// WithEnforceAuthorizationLabels is constructed once per route and routes
+// commonly share one process-wide registerer, a second registration of the
+// same counter is expected, not a bug: it is tolerated rather than panicking.
+func WithPrometheusRegisterer(reg prometheus.Registerer) Option {
+	return func(o *options) {
+		if reg == nil {
+			return
+		}
+
+		var alreadyRegistered prometheus.AlreadyRegisteredError
+
+		if err := reg.Register(enforcementTotal); err != nil && !errors.As(err, &alreadyRegistered) {
+			return
+		}
+
+		o.metricsRegistered = true
+	}
+}
+
+func recordResult(cfg *options, result string) {
+	if cfg.metricsRegistered {
+		enforcementTotal.WithLabelValues(result).Inc()
+	}
+}
+
+func emitAudit(cfg *options, r *http.Request, originalQuery string, injected []*labels.Matcher, finalQuery string) {
+	if cfg.auditLogger == nil {
+		return
+	}
+
+	tenant, _ := authentication.GetTenant(r.Context())
+	subject, _ := authorization.GetSubject(r.Context())
+
+	names := make([]string, len(injected))
+	for i, m := range injected {
+		names[i] = m.String()
+	}
+
+	cfg.auditLogger(AuditEvent{
+		Tenant:           tenant,
+		Subject:          subject,
+		OriginalQuery:    originalQuery,
+		InjectedMatchers: names,
+		FinalQuery:       finalQuery,
+	})
+}
+
+// forbiddenResponse is the structured denial body returned when enforcement
+// rejects a request, e.g. an EnforceModeIntersect violation.
+type forbiddenResponse struct {
+	Status    string   `json:"status"`
+	ErrorType string   `json:"errorType"`
+	Reasons   []string `json:"reasons"`
+}
+
+// writeForbidden writes a structured 403 body so clients can render the
+// denial reasons instead of a generic Prometheus-style error.
+func writeForbidden(w http.ResponseWriter, reasons []string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	_ = json.NewEncoder(w).Encode(forbiddenResponse{
+		Status:    "error",
+		ErrorType: "forbidden",
+		Reasons:   reasons,
+	})
+}
+
+// asForbidden extracts the reasons from err if it (or something it wraps) is
+// an *authzenforce.ForbiddenError.
+func asForbidden(err error) ([]string, bool) {
+	var forbidden *authzenforce.ForbiddenError
+	if errors.As(err, &forbidden) {
+		return forbidden.Reasons, true
+	}
+
+	return nil, false
+}
@@ -0,0 +1,264 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/golang/snappy"
+	"github.com/gogo/protobuf/proto"
+	lokipush "github.com/grafana/loki/pkg/push"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/observatorium/api/authzenforce"
+)
+
+// Option configures optional behaviour of WithEnforceAuthorizationLabels.
+// Most tenants don't need it, so it is opt-in via functional options rather
+// than always-on, to avoid buffering request bodies unnecessarily.
+type Option func(*options)
+
+type options struct {
+	signal   Signal
+	endpoint Endpoint
+
+	enforceRequestBody bool
+	auditLogger        func(AuditEvent)
+	metricsRegistered  bool
+}
+
+// WithEnforceRequestBody makes the middleware also rewrite the
+// "query"/"match[]" parameters carried in an
+// application/x-www-form-urlencoded POST body, and validate the stream
+// labels of a Loki /loki/api/v1/push payload against the authz matchers.
+// It is opt-in because it requires buffering the whole request body in
+// memory, so operators enable it per-tenant where it's needed.
+func WithEnforceRequestBody() Option {
+	return func(o *options) {
+		o.enforceRequestBody = true
+	}
+}
+
+const formURLEncoded = "application/x-www-form-urlencoded"
+
+// enforceRequestBody rewrites the query/match[] parameters of a POST form
+// body, or validates a Loki push payload, depending on endpoint. It returns
+// ok=false once it has already written an error or forbidden response.
+// rewrote reports whether it actually rewrote this request's selectors from
+// its POST body, so callers don't also re-derive and enforce them from
+// r.URL.Query(), which wouldn't carry them and would end up injecting a
+// second, broader selector instead.
+func enforceRequestBody(w http.ResponseWriter, r *http.Request, cfg *options, mInfo AuthzResponseData) (rewrote, ok bool) {
+	signal, endpoint := cfg.signal, cfg.endpoint
+
+	if r.Method != http.MethodPost {
+		return false, true
+	}
+
+	if endpoint == PushEndpoint {
+		return false, enforceLokiPush(w, r, cfg, mInfo)
+	}
+
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || contentType != formURLEncoded {
+		return false, true
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		handleEnforcementError(w, cfg, fmt.Errorf("could not read request body: %w", err))
+
+		return false, false
+	}
+
+	v, err := url.ParseQuery(string(body))
+	if err != nil {
+		handleEnforcementError(w, cfg, fmt.Errorf("could not parse request body: %w", err))
+
+		return false, false
+	}
+
+	var rewritten string
+
+	switch endpoint {
+	case SeriesEndpoint, LabelsEndpoint:
+		var rv url.Values
+		if endpoint == SeriesEndpoint {
+			rv, err = authzenforce.Series(v, mInfo.groups(), mInfo.enforceMode())
+		} else {
+			rv, err = authzenforce.Labels(v, mInfo.groups(), mInfo.enforceMode())
+		}
+
+		if err == nil {
+			rewritten = rv.Encode()
+		}
+	default:
+		rewritten, err = enforceValues(signal, mInfo, v)
+	}
+
+	if err != nil {
+		handleEnforcementError(w, cfg, err)
+
+		return false, false
+	}
+
+	setRequestBody(r, []byte(rewritten))
+	emitAudit(cfg, r, string(body), mInfo.flattened(), rewritten)
+
+	return true, true
+}
+
+// flattenMatchers ANDs every group's matchers together, coalescing "or"
+// groups into a single regex matcher per label first. It's used where a
+// pass/reject decision is needed rather than a selector rewrite, such as
+// validating a Loki push request's stream labels.
+func flattenMatchers(groups []authzenforce.MatcherGroup) ([]*labels.Matcher, error) {
+	var out []*labels.Matcher
+
+	for _, g := range groups {
+		gm := g.Matchers
+		if g.Op == authzenforce.OpOr {
+			var err error
+
+			gm, err = authzenforce.CoalesceOr(gm)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		out = append(out, gm...)
+	}
+
+	return out, nil
+}
+
+// parseStreamLabels parses a Loki stream label set, e.g. `{job="x"}`, into
+// labels.Labels so it can be matched against the authz matchers.
+func parseStreamLabels(s string) (labels.Labels, error) {
+	matchers, err := parser.ParseMetricSelector(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing stream labels %q: %w", s, err)
+	}
+
+	lbls := make(labels.Labels, 0, len(matchers))
+	for _, m := range matchers {
+		lbls = append(lbls, labels.Label{Name: m.Name, Value: m.Value})
+	}
+
+	return lbls, nil
+}
+
+// setRequestBody replaces r.Body with body and updates Content-Length so
+// downstream handlers and any reverse proxy forward the rewritten payload.
+func setRequestBody(r *http.Request, body []byte) {
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// enforceLokiPush validates that every stream in a /loki/api/v1/push payload
+// carries the authz matchers, rejecting the request with the offending
+// streams listed when that's not the case. It supports both the JSON and
+// the snappy-framed protobuf push formats Loki clients use.
+func enforceLokiPush(w http.ResponseWriter, r *http.Request, cfg *options, mInfo AuthzResponseData) bool {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		handleEnforcementError(w, cfg, fmt.Errorf("could not read push request body: %w", err))
+
+		return false
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var (
+		req      lokipush.PushRequest
+		reencode func(lokipush.PushRequest) ([]byte, error)
+	)
+
+	if contentType == "application/json" {
+		if err := json.Unmarshal(body, &req); err != nil {
+			handleEnforcementError(w, cfg, fmt.Errorf("could not parse push request: %w", err))
+
+			return false
+		}
+
+		reencode = func(req lokipush.PushRequest) ([]byte, error) { return json.Marshal(req) }
+	} else {
+		decoded, err := snappy.Decode(nil, body)
+		if err != nil {
+			handleEnforcementError(w, cfg, fmt.Errorf("could not decompress push request: %w", err))
+
+			return false
+		}
+
+		if err := proto.Unmarshal(decoded, &req); err != nil {
+			handleEnforcementError(w, cfg, fmt.Errorf("could not parse push request: %w", err))
+
+			return false
+		}
+
+		reencode = func(req lokipush.PushRequest) ([]byte, error) {
+			raw, err := proto.Marshal(&req)
+			if err != nil {
+				return nil, err
+			}
+
+			return snappy.Encode(nil, raw), nil
+		}
+	}
+
+	var offending []string
+
+	required, err := flattenMatchers(mInfo.groups())
+	if err != nil {
+		handleEnforcementError(w, cfg, err)
+
+		return false
+	}
+
+	for _, s := range req.Streams {
+		streamLabels, err := parseStreamLabels(s.Labels)
+		if err != nil {
+			offending = append(offending, s.Labels)
+
+			continue
+		}
+
+		for _, m := range required {
+			if !m.Matches(streamLabels.Get(m.Name)) {
+				offending = append(offending, s.Labels)
+
+				break
+			}
+		}
+	}
+
+	if len(offending) > 0 {
+		reasons := make([]string, len(offending))
+		for i, s := range offending {
+			reasons[i] = fmt.Sprintf("stream %s is not allowed by authorization policy", s)
+		}
+
+		recordResult(cfg, resultForbidden)
+		writeForbidden(w, reasons)
+
+		return false
+	}
+
+	reencoded, err := reencode(req)
+	if err != nil {
+		handleEnforcementError(w, cfg, fmt.Errorf("could not re-encode push request: %w", err))
+
+		return false
+	}
+
+	setRequestBody(r, reencoded)
+
+	return true
+}
@@ -0,0 +1,90 @@
+package http
+
+import (
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/observatorium/api/authzenforce"
+)
+
+func TestFlattenMatchersCoalescesOrGroups(t *testing.T) {
+	a, err := labels.NewMatcher(labels.MatchEqual, "namespace", "a")
+	if err != nil {
+		t.Fatalf("failed building matcher: %v", err)
+	}
+
+	b, err := labels.NewMatcher(labels.MatchEqual, "namespace", "b")
+	if err != nil {
+		t.Fatalf("failed building matcher: %v", err)
+	}
+
+	flat, err := flattenMatchers([]authzenforce.MatcherGroup{
+		{Op: authzenforce.OpOr, Matchers: []*labels.Matcher{a, b}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(flat) != 1 {
+		t.Fatalf("expected the or-group to coalesce into a single matcher, got %d", len(flat))
+	}
+
+	if !flat[0].Matches("a") || !flat[0].Matches("b") || flat[0].Matches("c") {
+		t.Fatalf("coalesced matcher %v does not match exactly {a, b}", flat[0])
+	}
+}
+
+func TestParseStreamLabels(t *testing.T) {
+	lbls, err := parseStreamLabels(`{job="x", namespace="a"}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := lbls.Get("namespace"); got != "a" {
+		t.Fatalf("namespace label = %q, want %q", got, "a")
+	}
+}
+
+func TestEnforceRequestBodyRewritesFormQuery(t *testing.T) {
+	namespaceMatcher, err := labels.NewMatcher(labels.MatchEqual, "namespace", "a")
+	if err != nil {
+		t.Fatalf("failed building matcher: %v", err)
+	}
+
+	mInfo := AuthzResponseData{Matchers: []*labels.Matcher{namespaceMatcher}}
+	cfg := &options{signal: LogsSignal, endpoint: QueryEndpoint}
+
+	body := url.Values{"query": {`{job="x"}`}}.Encode()
+	r := httptest.NewRequest("POST", "/query", strings.NewReader(body))
+	r.Header.Set("Content-Type", formURLEncoded)
+
+	w := httptest.NewRecorder()
+
+	rewrote, ok := enforceRequestBody(w, r, cfg, mInfo)
+	if !ok {
+		t.Fatalf("enforceRequestBody failed: %s", w.Body.String())
+	}
+
+	if !rewrote {
+		t.Fatalf("expected enforceRequestBody to report that it rewrote the form body")
+	}
+
+	rewritten, err := io.ReadAll(r.Body)
+	if err != nil {
+		t.Fatalf("failed reading rewritten body: %v", err)
+	}
+
+	v, err := url.ParseQuery(string(rewritten))
+	if err != nil {
+		t.Fatalf("failed parsing rewritten body: %v", err)
+	}
+
+	if !strings.Contains(v.Get("query"), `namespace="a"`) {
+		t.Fatalf("rewritten query %q does not carry the injected matcher", v.Get("query"))
+	}
+}
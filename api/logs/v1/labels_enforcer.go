@@ -4,24 +4,135 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strconv"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
 
 	"github.com/observatorium/api/authorization"
+	"github.com/observatorium/api/authzenforce"
 	"github.com/observatorium/api/httperr"
 	logqlv2 "github.com/observatorium/api/logql/v2"
-	"github.com/prometheus/prometheus/model/labels"
 )
 
+// AuthzResponseData is the JSON contract OPA rego policies in an
+// Observatorium policy bundle must produce to drive label enforcement.
+//
+//	{
+//	  "groups": [
+//	    {"op": "or", "matchers": [{"Type": 0, "Name": "namespace", "Value": "a"}, ...]},
+//	    {"op": "and", "matchers": [...]}
+//	  ],
+//	  "enforceMode": "append|replace|intersect"
+//	}
+//
+// matchers/logicalOp are the original, still-supported shorthand for a
+// single group: {"matchers": [...], "logicalOp": "or"} is equivalent to
+// {"groups": [{"op": "or", "matchers": [...]}]}.
+//
+// enforceMode applies to PromQL queries and to match[] selectors. LogQL
+// queries always have the authz matchers appended to every stream selector,
+// whatever enforceMode says.
 type AuthzResponseData struct {
 	Matchers  []*labels.Matcher `json:"matchers,omitempty"`
 	LogicalOp string            `json:"logicalOp,omitempty"`
+
+	Groups      []authzenforce.MatcherGroup `json:"groups,omitempty"`
+	EnforceMode string                      `json:"enforceMode,omitempty"`
 }
 
 const logicalOr = "or"
 
-// WithEnforceAuthorizationLabels return a middleware that ensures every query
-// has a set of labels returned by the OPA authorizer enforced.
-func WithEnforceAuthorizationLabels() func(http.Handler) http.Handler {
+// groups normalizes the legacy matchers/logicalOp shorthand and the richer
+// groups field into a single list of matcher groups.
+func (a AuthzResponseData) groups() []authzenforce.MatcherGroup {
+	if len(a.Groups) > 0 {
+		return a.Groups
+	}
+
+	op := authzenforce.OpAnd
+	if a.LogicalOp == logicalOr {
+		op = authzenforce.OpOr
+	}
+
+	return []authzenforce.MatcherGroup{{Op: op, Matchers: a.Matchers}}
+}
+
+// enforceMode defaults to "append", the original append-only behavior.
+func (a AuthzResponseData) enforceMode() string {
+	if a.EnforceMode == "" {
+		return authzenforce.EnforceModeAppend
+	}
+
+	return a.EnforceMode
+}
+
+// Signal identifies which query language a WithEnforceAuthorizationLabels
+// instance should parse and enforce matchers against.
+type Signal string
+
+const (
+	// LogsSignal enforces matchers on LogQL expressions.
+	LogsSignal Signal = "logs"
+	// MetricsSignal enforces matchers on PromQL expressions.
+	MetricsSignal Signal = "metrics"
+)
+
+// Endpoint identifies which API surface WithEnforceAuthorizationLabels is
+// enforcing matchers on, since each one carries its selectors differently.
+type Endpoint string
+
+const (
+	// QueryEndpoint covers /api/v1/query, /api/v1/query_range and their Loki
+	// equivalents, whose selectors live inside the "query" parameter.
+	QueryEndpoint Endpoint = "query"
+	// SeriesEndpoint covers /api/v1/series and /loki/api/v1/series, whose
+	// selectors live in one or more "match[]" parameters.
+	SeriesEndpoint Endpoint = "series"
+	// LabelsEndpoint covers /api/v1/labels, /api/v1/label/<name>/values and
+	// their Loki equivalents, which accept an optional "match[]" filter.
+	LabelsEndpoint Endpoint = "labels"
+	// RulesEndpoint covers /api/v1/rules: the response body is filtered
+	// instead of the request.
+	RulesEndpoint Endpoint = "rules"
+	// AlertsEndpoint covers /api/v1/alerts: the response body is filtered
+	// instead of the request.
+	AlertsEndpoint Endpoint = "alerts"
+	// PushEndpoint covers /loki/api/v1/push: the request body carries
+	// stream labels that must already satisfy the authz matchers.
+	PushEndpoint Endpoint = "push"
+)
+
+// WithSignal selects whether the "query" parameter is parsed as LogQL
+// (the default) or PromQL.
+func WithSignal(signal Signal) Option {
+	return func(o *options) {
+		o.signal = signal
+	}
+}
+
+// WithEndpoint selects how matchers are applied to the request or response.
+// Defaults to QueryEndpoint.
+func WithEndpoint(endpoint Endpoint) Option {
+	return func(o *options) {
+		o.endpoint = endpoint
+	}
+}
+
+// WithEnforceAuthorizationLabels return a middleware that ensures every
+// request has the set of labels returned by the OPA authorizer enforced.
+// Configure it with WithSignal and WithEndpoint so the router can wire each
+// handler to the matching enforcer; WithEnforceRequestBody additionally
+// enforces POST bodies, WithAuditLogger observes every rewrite, and
+// WithPrometheusRegisterer records enforcement outcomes as metrics.
+func WithEnforceAuthorizationLabels(opts ...Option) func(http.Handler) http.Handler {
+	cfg := &options{signal: LogsSignal, endpoint: QueryEndpoint}
+	for _, o := range opts {
+		o(cfg)
+	}
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			data, ok := authorization.GetData(r.Context())
@@ -46,22 +157,179 @@ func WithEnforceAuthorizationLabels() func(http.Handler) http.Handler {
 				return
 			}
 
-			q, err := enforceValues(matchersInfo, r.URL.Query())
-			if err != nil {
-				httperr.PrometheusAPIError(w, fmt.Sprintf("could not enforce authorization label matchers: %v", err), http.StatusInternalServerError)
+			var bodySelectorsRewritten bool
 
-				return
+			if cfg.enforceRequestBody {
+				rewrote, ok := enforceRequestBody(w, r, cfg, matchersInfo)
+				if !ok {
+					return
+				}
+
+				bodySelectorsRewritten = rewrote
 			}
-			r.URL.RawQuery = q
 
-			next.ServeHTTP(w, r)
+			switch cfg.endpoint {
+			case RulesEndpoint, AlertsEndpoint:
+				if err := enforceResponseBody(w, r, next, matchersInfo); err != nil {
+					handleEnforcementError(w, cfg, err)
+
+					return
+				}
+
+				recordResult(cfg, resultSuccess)
+			case SeriesEndpoint, LabelsEndpoint:
+				// If enforceRequestBody already rewrote this request's
+				// match[] selector(s) in its POST form body, the URL query
+				// string carries none of its own: re-running
+				// enforceMatchParam against r.URL.Query() here would inject
+				// a brand-new match[]={<authz matchers only>} alongside the
+				// body's, and Prometheus/Loki union multiple match[]
+				// values, silently broadening the request.
+				if bodySelectorsRewritten {
+					recordResult(cfg, resultSuccess)
+					next.ServeHTTP(w, r)
+
+					break
+				}
+
+				originalQuery := r.URL.RawQuery
+
+				if err := enforceMatchParam(r, cfg.endpoint, matchersInfo); err != nil {
+					handleEnforcementError(w, cfg, err)
+
+					return
+				}
+
+				recordResult(cfg, resultSuccess)
+				emitAudit(cfg, r, originalQuery, matchersInfo.flattened(), r.URL.RawQuery)
+				next.ServeHTTP(w, r)
+			default:
+				originalQuery := r.URL.Query().Get(queryParam)
+
+				q, err := enforceValues(cfg.signal, matchersInfo, r.URL.Query())
+				if err != nil {
+					handleEnforcementError(w, cfg, err)
+
+					return
+				}
+				r.URL.RawQuery = q
+
+				recordResult(cfg, resultSuccess)
+
+				// enforceRequestBody already reported a POST body rewrite;
+				// report this pass only if the URL carried a query too.
+				if !bodySelectorsRewritten || originalQuery != "" {
+					emitAudit(cfg, r, originalQuery, matchersInfo.flattened(), r.URL.Query().Get(queryParam))
+				}
+
+				next.ServeHTTP(w, r)
+			}
 		})
 	}
 }
 
-const queryParam = "query"
+// handleEnforcementError writes a structured 403 denial for a
+// *authzenforce.ForbiddenError, or a generic 500 for anything else, and
+// records the matching Prometheus counter.
+func handleEnforcementError(w http.ResponseWriter, cfg *options, err error) {
+	if reasons, ok := asForbidden(err); ok {
+		recordResult(cfg, resultForbidden)
+		writeForbidden(w, reasons)
+
+		return
+	}
+
+	recordResult(cfg, resultError)
+	httperr.PrometheusAPIError(w, fmt.Sprintf("could not enforce authorization label matchers: %v", err), http.StatusInternalServerError)
+}
+
+// flattened ANDs every group's matchers together (coalescing "or" groups
+// into regexes first), for reporting the matchers an audit event injected.
+// It lists every authz matcher, including, in EnforceModeIntersect, those the
+// query already satisfied and that were therefore not appended. By the time it's called the request has already been enforced
+// successfully, so a malformed group here can only affect what the audit
+// event reports, not the enforcement decision itself; it degrades to an
+// empty list rather than failing an already-successful request.
+func (a AuthzResponseData) flattened() []*labels.Matcher {
+	out, err := flattenMatchers(a.groups())
+	if err != nil {
+		return nil
+	}
+
+	return out
+}
+
+// enforceMatchParam rewrites the match[] parameter(s) of a series or
+// label(-values) request so that they also satisfy the authz matchers.
+func enforceMatchParam(r *http.Request, endpoint Endpoint, mInfo AuthzResponseData) error {
+	v := r.URL.Query()
+
+	var (
+		rewritten url.Values
+		err       error
+	)
+
+	if endpoint == SeriesEndpoint {
+		rewritten, err = authzenforce.Series(v, mInfo.groups(), mInfo.enforceMode())
+	} else {
+		rewritten, err = authzenforce.Labels(v, mInfo.groups(), mInfo.enforceMode())
+	}
+
+	if err != nil {
+		return err
+	}
+
+	r.URL.RawQuery = rewritten.Encode()
+
+	return nil
+}
+
+// enforceResponseBody lets the request through unchanged, then filters the
+// JSON rules/alerts response so it only contains entries whose labels
+// satisfy the authz matchers.
+func enforceResponseBody(w http.ResponseWriter, r *http.Request, next http.Handler, mInfo AuthzResponseData) error {
+	rec := httptest.NewRecorder()
+	next.ServeHTTP(rec, r)
+
+	for k, vs := range rec.Header() {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
 
-func enforceValues(mInfo AuthzResponseData, v url.Values) (values string, err error) {
+	if rec.Code != http.StatusOK {
+		w.WriteHeader(rec.Code)
+		_, _ = w.Write(rec.Body.Bytes())
+
+		return nil
+	}
+
+	filtered, err := authzenforce.FilterRulesOrAlerts(rec.Body.Bytes(), mInfo.groups())
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(filtered)))
+	w.WriteHeader(rec.Code)
+	_, _ = w.Write(filtered)
+
+	return nil
+}
+
+const (
+	queryParam      = "query"
+	queryExprsParam = "query_exprs"
+)
+
+func enforceValues(signal Signal, mInfo AuthzResponseData, v url.Values) (values string, err error) {
+	if signal == MetricsSignal {
+		return enforcePromQLValues(mInfo, v)
+	}
+
+	return enforceLogQLValues(mInfo, v)
+}
+
+func enforceLogQLValues(mInfo AuthzResponseData, v url.Values) (values string, err error) {
 	if v.Get(queryParam) == "" {
 		return v.Encode(), nil
 	}
@@ -71,21 +339,19 @@ func enforceValues(mInfo AuthzResponseData, v url.Values) (values string, err er
 		return "", fmt.Errorf("failed parsing LogQL expression: %w", err)
 	}
 
-	if mInfo.LogicalOp == logicalOr {
-		// Logical "OR" to combine multiple matchers needs to be done via LogPipelineExpr
-		expr.Walk(func(expr interface{}) {
-			switch le := expr.(type) {
-			case *logqlv2.LogQueryExpr:
-				le.AppendPipelineMatchers(mInfo.Matchers, logicalOr)
-			default:
-				// Do nothing
+	for _, g := range mInfo.groups() {
+		gm := g.Matchers
+		if g.Op == authzenforce.OpOr {
+			gm, err = authzenforce.CoalesceOr(gm)
+			if err != nil {
+				return "", err
 			}
-		})
-	} else {
+		}
+
 		expr.Walk(func(expr interface{}) {
 			switch le := expr.(type) {
 			case *logqlv2.StreamMatcherExpr:
-				le.AppendMatchers(mInfo.Matchers)
+				le.AppendMatchers(gm)
 			default:
 				// Do nothing
 			}
@@ -96,3 +362,149 @@ func enforceValues(mInfo AuthzResponseData, v url.Values) (values string, err er
 
 	return v.Encode(), nil
 }
+
+// enforcePromQLValues rewrites the "query" (or "query_exprs") parameter of a
+// PromQL request so that every vector selector carries the authz matchers,
+// mirroring what enforceLogQLValues does for LogQL.
+func enforcePromQLValues(mInfo AuthzResponseData, v url.Values) (values string, err error) {
+	param := queryParam
+	if v.Get(param) == "" {
+		param = queryExprsParam
+	}
+
+	if v.Get(param) == "" {
+		return v.Encode(), nil
+	}
+
+	expr, err := parser.ParseExpr(v.Get(param))
+	if err != nil {
+		return "", fmt.Errorf("failed parsing PromQL expression: %w", err)
+	}
+
+	groups := mInfo.groups()
+	enforceMode := mInfo.enforceMode()
+
+	var rewriteErr error
+
+	rewritten, err := rewriteVectorSelectors(expr, func(vs *parser.VectorSelector) parser.Expr {
+		filtered, toAppend, err := authzenforce.Resolve(vs.LabelMatchers, groups, enforceMode)
+		if err != nil {
+			rewriteErr = err
+
+			return vs
+		}
+
+		vs.LabelMatchers = append(filtered, toAppend...)
+
+		return vs
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if rewriteErr != nil {
+		return "", rewriteErr
+	}
+
+	v.Set(param, rewritten.String())
+
+	return v.Encode(), nil
+}
+
+// rewriteVectorSelectors walks expr and replaces every *parser.VectorSelector
+// with the result of fn, rebuilding the surrounding nodes as needed. It
+// covers the node kinds that can appear around a selector in practice:
+// parens, unary/binary expressions, calls, aggregations, subqueries and
+// range-vector (matrix) selectors such as the one rate()/increase() take. Any
+// other node kind is reported as an error rather than passed through
+// unenforced, since silently leaving an unrecognised selector unrewritten
+// would bypass authz enforcement.
+func rewriteVectorSelectors(expr parser.Expr, fn func(*parser.VectorSelector) parser.Expr) (parser.Expr, error) {
+	switch e := expr.(type) {
+	case *parser.VectorSelector:
+		return fn(e), nil
+	case *parser.MatrixSelector:
+		rewritten, err := rewriteVectorSelectors(e.VectorSelector, fn)
+		if err != nil {
+			return nil, err
+		}
+
+		e.VectorSelector = rewritten
+
+		return e, nil
+	case *parser.ParenExpr:
+		rewritten, err := rewriteVectorSelectors(e.Expr, fn)
+		if err != nil {
+			return nil, err
+		}
+
+		e.Expr = rewritten
+
+		return e, nil
+	case *parser.UnaryExpr:
+		rewritten, err := rewriteVectorSelectors(e.Expr, fn)
+		if err != nil {
+			return nil, err
+		}
+
+		e.Expr = rewritten
+
+		return e, nil
+	case *parser.BinaryExpr:
+		lhs, err := rewriteVectorSelectors(e.LHS, fn)
+		if err != nil {
+			return nil, err
+		}
+
+		rhs, err := rewriteVectorSelectors(e.RHS, fn)
+		if err != nil {
+			return nil, err
+		}
+
+		e.LHS, e.RHS = lhs, rhs
+
+		return e, nil
+	case *parser.AggregateExpr:
+		rewritten, err := rewriteVectorSelectors(e.Expr, fn)
+		if err != nil {
+			return nil, err
+		}
+
+		e.Expr = rewritten
+
+		if e.Param != nil {
+			param, err := rewriteVectorSelectors(e.Param, fn)
+			if err != nil {
+				return nil, err
+			}
+
+			e.Param = param
+		}
+
+		return e, nil
+	case *parser.SubqueryExpr:
+		rewritten, err := rewriteVectorSelectors(e.Expr, fn)
+		if err != nil {
+			return nil, err
+		}
+
+		e.Expr = rewritten
+
+		return e, nil
+	case *parser.Call:
+		for i, arg := range e.Args {
+			rewritten, err := rewriteVectorSelectors(arg, fn)
+			if err != nil {
+				return nil, err
+			}
+
+			e.Args[i] = rewritten
+		}
+
+		return e, nil
+	case *parser.NumberLiteral, *parser.StringLiteral:
+		return e, nil
+	default:
+		return nil, fmt.Errorf("unsupported PromQL expression type %T in authz selector rewrite", expr)
+	}
+}
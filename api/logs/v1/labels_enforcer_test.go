@@ -0,0 +1,34 @@
+package http
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestRewriteVectorSelectorsMatrixSelector(t *testing.T) {
+	expr, err := parser.ParseExpr(`rate(http_requests_total[5m])`)
+	if err != nil {
+		t.Fatalf("failed parsing PromQL expression: %v", err)
+	}
+
+	var seen int
+
+	rewritten, err := rewriteVectorSelectors(expr, func(vs *parser.VectorSelector) parser.Expr {
+		seen++
+		vs.Name = "rewritten_" + vs.Name
+
+		return vs
+	})
+	if err != nil {
+		t.Fatalf("unexpected rewriteVectorSelectors error: %v", err)
+	}
+
+	if seen != 1 {
+		t.Fatalf("expected the vector selector nested in the matrix selector to be visited once, got %d", seen)
+	}
+
+	if got, want := rewritten.String(), `rate(rewritten_http_requests_total{__name__="http_requests_total"}[5m])`; got != want {
+		t.Fatalf("rewritten expression = %q, want %q", got, want)
+	}
+}
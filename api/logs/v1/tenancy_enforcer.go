@@ -0,0 +1,101 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/observatorium/api/authentication"
+	"github.com/observatorium/api/httperr"
+)
+
+// WithEnforceTenancy returns a middleware that unconditionally injects a
+// {labelName="<tenant>"} matcher into every request, regardless of what (or
+// whether) OPA returned any authz matchers. It is a hard, policy-independent
+// tenancy guardrail meant to be chained ahead of or alongside
+// WithEnforceAuthorizationLabels, which can then add finer-grained rules on
+// top. The tenant is read from authentication.GetTenant(r.Context()), which
+// is populated by the authentication middleware earlier in the chain, not
+// from request headers: a client-controlled header is not a trustworthy
+// stand-in for an authenticated tenant. Requests that resolve to no tenant
+// at all are rejected.
+//
+// Being a hard guardrail, it also covers POST bodies the same way
+// WithEnforceRequestBody does for WithEnforceAuthorizationLabels: the
+// query/match[] form field and Loki push payloads are rewritten or
+// validated unconditionally, not just the URL query string, so a client
+// can't bypass tenant isolation by simply moving its selector into the
+// body.
+func WithEnforceTenancy(signal Signal, endpoint Endpoint, labelName string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tenant, ok := authentication.GetTenant(r.Context())
+			if !ok || tenant == "" {
+				httperr.PrometheusAPIError(w, "error finding tenant to enforce", http.StatusInternalServerError)
+
+				return
+			}
+
+			matcher, err := labels.NewMatcher(labels.MatchEqual, labelName, tenant)
+			if err != nil {
+				httperr.PrometheusAPIError(w, fmt.Sprintf("could not build tenancy matcher: %v", err), http.StatusInternalServerError)
+
+				return
+			}
+
+			mInfo := AuthzResponseData{Matchers: []*labels.Matcher{matcher}}
+			cfg := &options{signal: signal, endpoint: endpoint}
+
+			bodySelectorsRewritten, ok := enforceRequestBody(w, r, cfg, mInfo)
+			if !ok {
+				return
+			}
+
+			switch endpoint {
+			case RulesEndpoint, AlertsEndpoint:
+				if err := enforceResponseBody(w, r, next, mInfo); err != nil {
+					httperr.PrometheusAPIError(w, fmt.Sprintf("could not enforce tenancy: %v", err), http.StatusInternalServerError)
+
+					return
+				}
+			case SeriesEndpoint, LabelsEndpoint:
+				// See the equivalent guard in WithEnforceAuthorizationLabels:
+				// once the POST body's match[] has been rewritten, the URL
+				// query string carries none of its own, and re-running
+				// enforceMatchParam against it would inject a second,
+				// broader match[] rather than tightening the one already in
+				// the body.
+				if bodySelectorsRewritten {
+					next.ServeHTTP(w, r)
+
+					break
+				}
+
+				if err := enforceMatchParam(r, endpoint, mInfo); err != nil {
+					httperr.PrometheusAPIError(w, fmt.Sprintf("could not enforce tenancy: %v", err), http.StatusInternalServerError)
+
+					return
+				}
+
+				next.ServeHTTP(w, r)
+			default:
+				if bodySelectorsRewritten {
+					next.ServeHTTP(w, r)
+
+					break
+				}
+
+				q, err := enforceValues(signal, mInfo, r.URL.Query())
+				if err != nil {
+					httperr.PrometheusAPIError(w, fmt.Sprintf("could not enforce tenancy: %v", err), http.StatusInternalServerError)
+
+					return
+				}
+				r.URL.RawQuery = q
+
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}